@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// CheckpointStatus tracks how far a single PhotoURL has progressed through
+// download and hashing, so a re-invocation can resume instead of starting
+// the whole CSV over.
+type CheckpointStatus string
+
+const (
+	StatusPending    CheckpointStatus = "pending"
+	StatusDownloaded CheckpointStatus = "downloaded"
+	StatusHashed     CheckpointStatus = "hashed"
+	StatusFailed     CheckpointStatus = "failed"
+)
+
+// Checkpoint is the resume state recorded for one PhotoURL.
+type Checkpoint struct {
+	Status CheckpointStatus
+	SHA1   string
+	Phash  int64
+}
+
+// CheckpointStore is a small SQLite-backed log of per-URL progress, in the
+// same spirit as an fsck that records the last record it processed so a
+// re-run can pick up where it left off instead of redoing finished work.
+type CheckpointStore struct {
+	db *sql.DB
+}
+
+// OpenCheckpointStore opens (or creates) the checkpoint database at path. A
+// busy timeout lets SQLite wait out a lock instead of immediately returning
+// SQLITE_BUSY when the worker pool's concurrent MarkDownloaded/MarkHashed
+// calls collide.
+func OpenCheckpointStore(path string) (*CheckpointStore, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("open checkpoint store %s: %w", path, err)
+	}
+
+	const schema = `
+CREATE TABLE IF NOT EXISTS checkpoints (
+	photo_url TEXT PRIMARY KEY,
+	status    TEXT NOT NULL,
+	sha1      TEXT NOT NULL DEFAULT '',
+	phash     INTEGER NOT NULL DEFAULT 0
+);
+`
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create checkpoints table: %w", err)
+	}
+
+	return &CheckpointStore{db: db}, nil
+}
+
+// Close closes the underlying database connection.
+func (c *CheckpointStore) Close() error {
+	return c.db.Close()
+}
+
+// Get returns the recorded checkpoint for photoURL, and ok=false if there is
+// none yet.
+func (c *CheckpointStore) Get(photoURL string) (Checkpoint, bool, error) {
+	var cp Checkpoint
+	var status string
+	err := c.db.QueryRow(
+		`SELECT status, sha1, phash FROM checkpoints WHERE photo_url = ?`, photoURL,
+	).Scan(&status, &cp.SHA1, &cp.Phash)
+	if err == sql.ErrNoRows {
+		return Checkpoint{}, false, nil
+	}
+	if err != nil {
+		return Checkpoint{}, false, fmt.Errorf("get checkpoint for %s: %w", photoURL, err)
+	}
+	cp.Status = CheckpointStatus(status)
+	return cp, true, nil
+}
+
+// MarkDownloaded records that photoURL's bytes were fetched and cached under
+// the given SHA-1, with hashing still to come.
+func (c *CheckpointStore) MarkDownloaded(photoURL, sha1 string) error {
+	return c.upsert(photoURL, StatusDownloaded, sha1, 0)
+}
+
+// MarkHashed records that photoURL finished hashing.
+func (c *CheckpointStore) MarkHashed(photoURL, sha1 string, phash int64) error {
+	return c.upsert(photoURL, StatusHashed, sha1, phash)
+}
+
+// MarkFailed records that photoURL could not be downloaded or hashed.
+func (c *CheckpointStore) MarkFailed(photoURL string) error {
+	return c.upsert(photoURL, StatusFailed, "", 0)
+}
+
+func (c *CheckpointStore) upsert(photoURL string, status CheckpointStatus, sha1 string, phash int64) error {
+	_, err := c.db.Exec(
+		`INSERT INTO checkpoints (photo_url, status, sha1, phash) VALUES (?, ?, ?, ?)
+		 ON CONFLICT(photo_url) DO UPDATE SET status = excluded.status, sha1 = excluded.sha1, phash = excluded.phash`,
+		photoURL, string(status), sha1, phash,
+	)
+	if err != nil {
+		return fmt.Errorf("record checkpoint for %s: %w", photoURL, err)
+	}
+	return nil
+}
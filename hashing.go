@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"sync"
+
+	"github.com/corona10/goimagehash"
+	"github.com/febryansambuari/duplicate-image-detection/phashindex"
+)
+
+// HashKind selects which perceptual hashing algorithm (or combination of
+// algorithms) detectDuplicates uses to flag duplicates.
+type HashKind string
+
+const (
+	HashKindPHash     HashKind = "phash"
+	HashKindAHash     HashKind = "ahash"
+	HashKindDHash     HashKind = "dhash"
+	HashKindPHash256  HashKind = "phash256"
+	HashKindComposite HashKind = "composite"
+)
+
+// parseHashKind validates the --hash flag value.
+func parseHashKind(s string) (HashKind, error) {
+	switch k := HashKind(s); k {
+	case HashKindPHash, HashKindAHash, HashKindDHash, HashKindPHash256, HashKindComposite:
+		return k, nil
+	default:
+		return "", fmt.Errorf("unknown --hash value %q (want phash, ahash, dhash, phash256, or composite)", s)
+	}
+}
+
+// HashTriple bundles all three 64-bit algorithms computed for a single
+// image, used by --hash=composite and persisted for every image so a later
+// run can answer a different --hash query without re-downloading it.
+type HashTriple struct {
+	PHash *goimagehash.ImageHash
+	AHash *goimagehash.ImageHash
+	DHash *goimagehash.ImageHash
+}
+
+// selectHash picks the algorithm kind selects out of an already-computed
+// HashTriple; it's only called for kind in {phash, ahash, dhash}.
+func selectHash(t HashTriple, kind HashKind) *goimagehash.ImageHash {
+	switch kind {
+	case HashKindAHash:
+		return t.AHash
+	case HashKindDHash:
+		return t.DHash
+	default:
+		return t.PHash
+	}
+}
+
+// computeHashTriple computes phash, ahash and dhash together.
+func computeHashTriple(img image.Image) (HashTriple, error) {
+	phash, err := goimagehash.PerceptionHash(img)
+	if err != nil {
+		return HashTriple{}, err
+	}
+	ahash, err := goimagehash.AverageHash(img)
+	if err != nil {
+		return HashTriple{}, err
+	}
+	dhash, err := goimagehash.DifferenceHash(img)
+	if err != nil {
+		return HashTriple{}, err
+	}
+	return HashTriple{PHash: phash, AHash: ahash, DHash: dhash}, nil
+}
+
+// CompositeWeights weighs each algorithm's Hamming distance when
+// --hash=composite combines them into a single score.
+type CompositeWeights struct {
+	PHash float64
+	AHash float64
+	DHash float64
+}
+
+// compositeDistance combines the three per-algorithm Hamming distances
+// between a and b into a single weighted score.
+func compositeDistance(a, b HashTriple, w CompositeWeights) (float64, error) {
+	dP, err := a.PHash.Distance(b.PHash)
+	if err != nil {
+		return 0, err
+	}
+	dA, err := a.AHash.Distance(b.AHash)
+	if err != nil {
+		return 0, err
+	}
+	dD, err := a.DHash.Distance(b.DHash)
+	if err != nil {
+		return 0, err
+	}
+	return w.PHash*float64(dP) + w.AHash*float64(dA) + w.DHash*float64(dD), nil
+}
+
+// compositeMatch is a hit returned by CompositeIndex.Query.
+type compositeMatch struct {
+	Record   phashindex.ImageRecord
+	Distance float64
+}
+
+// CompositeIndex is a linear-scan index over HashTriple values. The
+// weighted composite distance isn't a single Hamming metric, so it doesn't
+// fit the BK-tree's triangle-inequality pruning; a flat scan is the
+// straightforward correct structure until composite mode needs to scale
+// past what that costs.
+type CompositeIndex struct {
+	mu      sync.RWMutex
+	weights CompositeWeights
+	entries []compositeEntry
+}
+
+type compositeEntry struct {
+	record phashindex.ImageRecord
+	hashes HashTriple
+}
+
+// NewCompositeIndex returns an empty index that scores matches using w.
+func NewCompositeIndex(w CompositeWeights) *CompositeIndex {
+	return &CompositeIndex{weights: w}
+}
+
+// Insert adds hashes/record to the index.
+func (c *CompositeIndex) Insert(hashes HashTriple, record phashindex.ImageRecord) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = append(c.entries, compositeEntry{record: record, hashes: hashes})
+}
+
+// Query returns every record whose weighted composite distance to hashes is
+// at most maxDistance.
+func (c *CompositeIndex) Query(hashes HashTriple, maxDistance float64) []compositeMatch {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var matches []compositeMatch
+	for _, entry := range c.entries {
+		d, err := compositeDistance(hashes, entry.hashes, c.weights)
+		if err != nil {
+			continue
+		}
+		if d <= maxDistance {
+			matches = append(matches, compositeMatch{Record: entry.record, Distance: d})
+		}
+	}
+	return matches
+}
+
+// ext256Match is a hit returned by Ext256Index.Query.
+type ext256Match struct {
+	Record   phashindex.ImageRecord
+	Distance int
+}
+
+// Ext256Index is a linear-scan index over 256-bit ExtPerceptionHash values
+// (--hash=phash256), which, like CompositeIndex, doesn't fit the 64-bit
+// BK-tree.
+type Ext256Index struct {
+	mu      sync.RWMutex
+	entries []ext256Entry
+}
+
+type ext256Entry struct {
+	record phashindex.ImageRecord
+	hash   *goimagehash.ExtImageHash
+}
+
+// NewExt256Index returns an empty 256-bit hash index.
+func NewExt256Index() *Ext256Index {
+	return &Ext256Index{}
+}
+
+// Insert adds hash/record to the index.
+func (e *Ext256Index) Insert(hash *goimagehash.ExtImageHash, record phashindex.ImageRecord) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.entries = append(e.entries, ext256Entry{record: record, hash: hash})
+}
+
+// Query returns every record within maxDistance of hash.
+func (e *Ext256Index) Query(hash *goimagehash.ExtImageHash, maxDistance int) []ext256Match {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	var matches []ext256Match
+	for _, entry := range e.entries {
+		d, err := hash.Distance(entry.hash)
+		if err != nil {
+			continue
+		}
+		if d <= maxDistance {
+			matches = append(matches, ext256Match{Record: entry.record, Distance: d})
+		}
+	}
+	return matches
+}
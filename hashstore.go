@@ -0,0 +1,114 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/corona10/goimagehash"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// HashStore persists perceptual hashes in SQLite so that duplicate detection
+// survives across runs and scales past what an in-memory sync.Map can hold.
+type HashStore struct {
+	db *sql.DB
+}
+
+// OpenHashStore opens (or creates) the SQLite database at path. Duplicate
+// lookups go through the in-memory phashindex.BKTree (and the composite/
+// ext256 indexes), not SQL, so this just needs the plain sqlite3 driver. A
+// busy timeout lets SQLite wait out a lock instead of immediately returning
+// SQLITE_BUSY when the worker pool's concurrent Insert calls collide.
+func OpenHashStore(path string) (*HashStore, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("open hash store %s: %w", path, err)
+	}
+
+	const schema = `
+CREATE TABLE IF NOT EXISTS hashes (
+	id            TEXT NOT NULL,
+	store_id      TEXT NOT NULL,
+	frontliner_id TEXT NOT NULL,
+	photo_url     TEXT NOT NULL UNIQUE,
+	phash         INTEGER NOT NULL,
+	ahash         INTEGER NOT NULL DEFAULT 0,
+	dhash         INTEGER NOT NULL DEFAULT 0,
+	phash256      TEXT NOT NULL DEFAULT ''
+);
+`
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create hashes table: %w", err)
+	}
+
+	return &HashStore{db: db}, nil
+}
+
+// Close closes the underlying database connection.
+func (s *HashStore) Close() error {
+	return s.db.Close()
+}
+
+// HashRow is a single stored record together with every hash algorithm
+// computed for it, as returned by All. PHash256 is the hex dump of a 256-bit
+// ExtPerceptionHash, or "" if it wasn't computed for that row.
+type HashRow struct {
+	Record   ImageRecord
+	PHash    int64
+	AHash    int64
+	DHash    int64
+	PHash256 string
+}
+
+// All returns every row currently in the store, used to warm-start an
+// in-memory index (see phashindex.BKTree) from a prior run's persisted
+// hashes.
+func (s *HashStore) All() ([]HashRow, error) {
+	rows, err := s.db.Query(`SELECT id, store_id, frontliner_id, photo_url, phash, ahash, dhash, phash256 FROM hashes`)
+	if err != nil {
+		return nil, fmt.Errorf("query all hashes: %w", err)
+	}
+	defer rows.Close()
+
+	var all []HashRow
+	for rows.Next() {
+		var row HashRow
+		if err := rows.Scan(&row.Record.ID, &row.Record.StoreID, &row.Record.FrontlinerID, &row.Record.PhotoURL, &row.PHash, &row.AHash, &row.DHash, &row.PHash256); err != nil {
+			return nil, fmt.Errorf("scan hash row: %w", err)
+		}
+		all = append(all, row)
+	}
+	return all, rows.Err()
+}
+
+// Insert commits a newly hashed record so the process is crash-safe: once
+// Insert returns nil, that record survives even if the process dies
+// immediately after, and will be loaded back into the in-memory index by
+// All on the next run. Every algorithm computed for this run is persisted
+// together so a later run can answer a different --hash query without
+// re-downloading and re-hashing every image.
+func (s *HashStore) Insert(record ImageRecord, hashes HashRow) error {
+	_, err := s.db.Exec(
+		`INSERT OR IGNORE INTO hashes (id, store_id, frontliner_id, photo_url, phash, ahash, dhash, phash256) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		record.ID, record.StoreID, record.FrontlinerID, record.PhotoURL,
+		hashes.PHash, hashes.AHash, hashes.DHash, hashes.PHash256,
+	)
+	if err != nil {
+		return fmt.Errorf("insert hash for %s: %w", record.PhotoURL, err)
+	}
+	return nil
+}
+
+// int64FromHash converts a goimagehash 64-bit hash to a signed int64 for
+// storage in SQLite, which has no native unsigned integer type.
+func int64FromHash(h *goimagehash.ImageHash) int64 {
+	return int64(h.GetHash())
+}
+
+// imageHashFromInt64 reverses int64FromHash. kind must match the algorithm
+// the hash was computed with: ImageHash.Distance refuses to compare hashes
+// of different kinds.
+func imageHashFromInt64(v int64, kind goimagehash.Kind) *goimagehash.ImageHash {
+	return goimagehash.NewImageHash(uint64(v), kind)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ImageCache is a content-addressed store of downloaded image bytes on disk,
+// so a re-run (or a URL repeated within the same CSV) can be served from
+// local disk instead of re-hitting HTTP.
+type ImageCache struct {
+	dir string
+
+	partialMu sync.Mutex
+	partial   map[string]*sync.Mutex
+}
+
+// NewImageCache returns a cache rooted at dir, creating it if necessary.
+func NewImageCache(dir string) (*ImageCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create cache dir %s: %w", dir, err)
+	}
+	return &ImageCache{dir: dir, partial: make(map[string]*sync.Mutex)}, nil
+}
+
+// LockPartial serializes access to url's staged partial download, so two
+// workers downloading the same URL at once (duplicate rows in the CSV)
+// can't interleave reads/appends/clears against the same file. Call the
+// returned func to release the lock.
+func (c *ImageCache) LockPartial(url string) func() {
+	c.partialMu.Lock()
+	l, ok := c.partial[url]
+	if !ok {
+		l = &sync.Mutex{}
+		c.partial[url] = l
+	}
+	c.partialMu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// pathFor returns the path bytes with the given SHA-1 digest are stored at:
+// cache/<sha1[:2]>/<sha1>, sharded by the first byte to keep any one
+// directory from holding hundreds of thousands of entries.
+func (c *ImageCache) pathFor(sha1Hex string) string {
+	return filepath.Join(c.dir, sha1Hex[:2], sha1Hex)
+}
+
+// Has reports whether bytes for sha1Hex are already cached.
+func (c *ImageCache) Has(sha1Hex string) bool {
+	_, err := os.Stat(c.pathFor(sha1Hex))
+	return err == nil
+}
+
+// Load reads the cached bytes for sha1Hex.
+func (c *ImageCache) Load(sha1Hex string) ([]byte, error) {
+	return os.ReadFile(c.pathFor(sha1Hex))
+}
+
+// Store writes data to the cache under its SHA-1 digest and returns the
+// hex-encoded digest.
+func (c *ImageCache) Store(data []byte) (string, error) {
+	sum := sha1.Sum(data)
+	sha1Hex := hex.EncodeToString(sum[:])
+
+	path := c.pathFor(sha1Hex)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", fmt.Errorf("create cache shard for %s: %w", sha1Hex, err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return "", fmt.Errorf("write cache entry for %s: %w", sha1Hex, err)
+	}
+	return sha1Hex, nil
+}
+
+// partialPathFor returns the staging path for an in-progress download of
+// url. Unlike the content-addressed store, this is keyed by the URL itself
+// (a download isn't complete enough to know its final SHA-1 yet), so it
+// lives in its own shard under the cache dir.
+func (c *ImageCache) partialPathFor(url string) string {
+	sum := sha1.Sum([]byte(url))
+	urlHex := hex.EncodeToString(sum[:])
+	return filepath.Join(c.dir, ".partial", urlHex[:2], urlHex)
+}
+
+// LoadPartial returns the bytes downloaded for url so far, or nil if there
+// is no in-progress download staged for it.
+func (c *ImageCache) LoadPartial(url string) ([]byte, error) {
+	data, err := os.ReadFile(c.partialPathFor(url))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// AppendPartial appends data to the staged partial download for url,
+// creating it if necessary, so a later attempt can resume with a Range
+// request instead of re-downloading bytes already on disk.
+func (c *ImageCache) AppendPartial(url string, data []byte) error {
+	path := c.partialPathFor(url)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("create partial cache shard for %s: %w", url, err)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("open partial download for %s: %w", url, err)
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	return err
+}
+
+// ClearPartial discards the staged partial download for url, once it has
+// either completed (and been committed via Store) or been restarted from
+// scratch with a fresh, non-Range request.
+func (c *ImageCache) ClearPartial(url string) error {
+	err := os.Remove(c.partialPathFor(url))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -1,18 +1,27 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/csv"
+	"flag"
 	"fmt"
 	"image"
 	"io"
 	"log"
+	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/cheggaaa/pb/v3"
 	"github.com/corona10/goimagehash"
+	"github.com/febryansambuari/duplicate-image-detection/phashindex"
 	"github.com/xuri/excelize/v2"
 	_ "image/jpeg"
 	_ "image/png"
@@ -40,39 +49,185 @@ type FailedRecord struct {
 	StoreID      string
 	FrontlinerID string
 	PhotoURL     string
+	LastStatus   int // HTTP status of the last attempt, or 0 if it never got a response
 }
 
-// downloadImage fetches and decodes an image from a URL with retry logic.
-func downloadImage(url string) (image.Image, error) {
-	var img image.Image
-	var _ error
+const (
+	maxDownloadAttempts = 6
+	backoffBase         = 500 * time.Millisecond
+	backoffMax          = 30 * time.Second
+)
+
+// downloadImageBytes fetches the raw bytes of an image from a URL, retrying
+// only transient failures (network errors, 5xx, and 429) with exponential
+// backoff and jitter between attempts, honoring Retry-After when the server
+// sends one. Non-transient statuses (4xx other than 429) fail immediately,
+// since retrying them would never succeed.
+//
+// If a prior attempt (this call or an earlier, interrupted run) left a
+// partial download staged in cache, it resumes with a Range request instead
+// of starting over; a 200 response means the server ignored the Range and
+// sent the whole body, so that replaces rather than extends what's staged.
+//
+// limiter throttles requests per-host so a single bursty CDN doesn't get the
+// whole job rate-limited or banned.
+func downloadImageBytes(ctx context.Context, rawURL string, cache *ImageCache, limiter *HostLimiter) ([]byte, int, error) {
+	// Only one in-flight download per URL: duplicate PhotoURL rows in the
+	// CSV would otherwise let two workers read/append/clear the same staged
+	// partial-download file at once and corrupt it.
+	unlock := cache.LockPartial(rawURL)
+	defer unlock()
+
+	partial, err := cache.LoadPartial(rawURL)
+	if err != nil {
+		return nil, 0, fmt.Errorf("read partial download for %s: %w", rawURL, err)
+	}
+
+	lastStatus := 0
+	for attempt := 0; attempt < maxDownloadAttempts; attempt++ {
+		if ctx.Err() != nil {
+			return nil, lastStatus, ctx.Err()
+		}
+
+		if err := limiter.Wait(ctx, rawURL); err != nil {
+			return nil, lastStatus, err
+		}
 
-	maxRetries := 3
-	for attempts := 1; attempts <= maxRetries; attempts++ {
 		log.Print("Downloading image....")
-		resp, err := httpClient.Get(url)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
 		if err != nil {
-			log.Printf("Attempt %d: Failed to download image from %s: %v\n", attempts, url, err)
-			time.Sleep(120 * time.Second) // Wait before retrying
+			return nil, lastStatus, fmt.Errorf("build request for %s: %w", rawURL, err)
+		}
+		if len(partial) > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", len(partial)))
+		}
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			log.Printf("Attempt %d: Failed to download image from %s: %v\n", attempt+1, rawURL, err)
+			if !backoffWait(ctx, attempt, 0) {
+				return nil, lastStatus, ctx.Err()
+			}
 			continue
 		}
-		defer func(Body io.ReadCloser) {
-			err := Body.Close()
-			if err != nil {
 
+		lastStatus = resp.StatusCode
+
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+			resp.Body.Close()
+			log.Printf("Attempt %d: transient status %d downloading %s\n", attempt+1, resp.StatusCode, rawURL)
+			if !backoffWait(ctx, attempt, retryAfter) {
+				return nil, lastStatus, ctx.Err()
 			}
-		}(resp.Body)
+			continue
+		}
+
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			return nil, lastStatus, fmt.Errorf("unexpected status %d downloading %s", resp.StatusCode, rawURL)
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			log.Printf("Attempt %d: Failed to read image body from %s: %v\n", attempt+1, rawURL, err)
+			if !backoffWait(ctx, attempt, 0) {
+				return nil, lastStatus, ctx.Err()
+			}
+			continue
+		}
+
+		if resp.StatusCode == http.StatusPartialContent {
+			partial = append(partial, body...)
+			if err := cache.AppendPartial(rawURL, body); err != nil {
+				log.Printf("Failed to persist partial download for %s: %v\n", rawURL, err)
+			}
+		} else {
+			// The server ignored our Range request and sent the full body.
+			partial = body
+		}
+
+		if err := cache.ClearPartial(rawURL); err != nil {
+			log.Printf("Failed to clear partial download for %s: %v\n", rawURL, err)
+		}
+		return partial, lastStatus, nil
+	}
+
+	return nil, lastStatus, fmt.Errorf("failed to download image from %s after %d attempts (last status %d)", rawURL, maxDownloadAttempts, lastStatus)
+}
 
-		img, _, err = image.Decode(resp.Body)
-		if err == nil {
-			return img, nil
+// backoffWait sleeps before the next retry attempt (0-indexed) and reports
+// whether it ran to completion; it returns false if ctx was cancelled
+// first. retryAfter, when non-zero, overrides the computed backoff delay so
+// a server's Retry-After header is honored exactly.
+func backoffWait(ctx context.Context, attempt int, retryAfter time.Duration) bool {
+	delay := retryAfter
+	if delay <= 0 {
+		delay = backoffBase * time.Duration(1<<attempt)
+		if delay > backoffMax {
+			delay = backoffMax
 		}
+		delay += time.Duration(rand.Int63n(int64(backoffBase)))
+	}
+	return !sleepOrDone(ctx, delay)
+}
+
+// parseRetryAfter interprets a Retry-After header value given in seconds,
+// returning 0 if it's absent or not a delta-seconds value.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	seconds, err := strconv.Atoi(v)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
 
-		log.Printf("Attempt %d: Failed to decode image from %s: %v\n", attempts, url, err)
-		time.Sleep(120 * time.Second) // Wait before retrying
+// sleepOrDone waits for d, returning early (and reporting true) if ctx is
+// cancelled first, so Ctrl-C doesn't have to wait out a full retry delay.
+func sleepOrDone(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return true
 	}
+}
 
-	return nil, fmt.Errorf("failed to download image from %s after %d attempts", url, maxRetries)
+// decodeImage decodes raw image bytes previously fetched by
+// downloadImageBytes (or read back from the on-disk image cache).
+func decodeImage(data []byte) (image.Image, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+// fetchImageBytes returns the bytes for url, preferring the on-disk cache
+// over the network when a prior run already downloaded and cached this
+// exact URL. It returns the bytes along with their SHA-1 digest and the last
+// HTTP status observed (0 if it was served entirely from cache).
+func fetchImageBytes(ctx context.Context, url string, cache *ImageCache, checkpoints *CheckpointStore, limiter *HostLimiter) ([]byte, string, int, error) {
+	if cp, ok, err := checkpoints.Get(url); err == nil && ok && cp.SHA1 != "" && cache.Has(cp.SHA1) {
+		if data, err := cache.Load(cp.SHA1); err == nil {
+			return data, cp.SHA1, 0, nil
+		}
+	}
+
+	data, status, err := downloadImageBytes(ctx, url, cache, limiter)
+	if err != nil {
+		return nil, "", status, err
+	}
+
+	sha1Hex, err := cache.Store(data)
+	if err != nil {
+		return nil, "", status, fmt.Errorf("cache image from %s: %w", url, err)
+	}
+
+	return data, sha1Hex, status, nil
 }
 
 // parseCSV reads image records from a CSV file.
@@ -110,12 +265,30 @@ func parseCSV(filename string) ([]ImageRecord, error) {
 	return imageRecords, nil
 }
 
+// ScanConfig bundles the hashing strategy for a run: which algorithm(s) to
+// compute, the threshold that decides a duplicate, and the index each
+// strategy looks candidates up in.
+type ScanConfig struct {
+	HashKind           HashKind
+	Threshold          int // Hamming threshold for phash/ahash/dhash/phash256
+	CompositeThreshold float64
+
+	Index          *phashindex.BKTree // used when HashKind is phash, ahash, or dhash
+	CompositeIndex *CompositeIndex    // used when HashKind is composite
+	Ext256Index    *Ext256Index       // used when HashKind is phash256
+
+	Limiter *HostLimiter // throttles download requests per host
+}
+
 // detectDuplicates identifies duplicate images and tracks failed records.
-func detectDuplicates(imageRecords []ImageRecord, threshold int) ([]DuplicateRecord, []FailedRecord) {
-	var hashStore sync.Map
+// Hashes are persisted in store so the process is crash-safe and can resume,
+// while lookups against already-seen images go through whichever index cfg
+// selects, each answering a "within threshold" query faster than scanning
+// every previous image.
+func detectDuplicates(ctx context.Context, imageRecords []ImageRecord, store *HashStore, checkpoints *CheckpointStore, cache *ImageCache, resume bool, bar *pb.ProgressBar, cfg ScanConfig) ([]DuplicateRecord, []FailedRecord) {
 	duplicateMap := make(map[string]map[string]*DuplicateRecord)
 	var failedRecords []FailedRecord
-	var mu sync.Mutex // Protects shared data (failedRecords)
+	var mu sync.Mutex // Protects shared data (failedRecords, duplicateMap)
 
 	// Worker pool
 	numWorkers := 10
@@ -128,62 +301,151 @@ func detectDuplicates(imageRecords []ImageRecord, threshold int) ([]DuplicateRec
 
 	// Worker function
 	worker := func() {
+		finish := func() {
+			bar.Increment()
+			results <- struct{}{}
+		}
+
 		for record := range jobs {
-			img, err := downloadImage(record.PhotoURL)
+			if ctx.Err() != nil {
+				finish()
+				continue
+			}
+
+			cp, ok, err := checkpoints.Get(record.PhotoURL)
+			if err != nil {
+				log.Printf("Failed to read checkpoint for %s: %v\n", record.PhotoURL, err)
+			} else if ok && cp.Status == StatusHashed {
+				// Already hashed and indexed, in this run or a prior one:
+				// skip unconditionally rather than rehashing and matching
+				// this PhotoURL against its own earlier entry, which would
+				// otherwise report every already-seen row as a duplicate of
+				// itself on a plain rerun of the same CSV.
+				finish()
+				continue
+			} else if ok && resume && cp.Status == StatusFailed {
+				finish()
+				continue
+			}
+
+			data, sha1Hex, status, err := fetchImageBytes(ctx, record.PhotoURL, cache, checkpoints, cfg.Limiter)
 			if err != nil {
 				log.Printf("Failed to download image from %s: %v\n", record.PhotoURL, err)
+				if err := checkpoints.MarkFailed(record.PhotoURL); err != nil {
+					log.Printf("Failed to record checkpoint for %s: %v\n", record.PhotoURL, err)
+				}
 				mu.Lock()
 				failedRecords = append(failedRecords, FailedRecord{
 					ID:           record.ID,
 					StoreID:      record.StoreID,
 					FrontlinerID: record.FrontlinerID,
 					PhotoURL:     record.PhotoURL,
+					LastStatus:   status,
 				})
 				mu.Unlock()
-				results <- struct{}{}
+				finish()
+				continue
+			}
+			if err := checkpoints.MarkDownloaded(record.PhotoURL, sha1Hex); err != nil {
+				log.Printf("Failed to record checkpoint for %s: %v\n", record.PhotoURL, err)
+			}
+
+			img, err := decodeImage(data)
+			if err != nil {
+				log.Printf("Failed to decode image from %s: %v\n", record.PhotoURL, err)
+				finish()
 				continue
 			}
 
-			hash, err := goimagehash.PerceptionHash(img)
+			// Every run persists phash/ahash/dhash together, regardless of
+			// which one (if any) decides duplicates this run, so a later
+			// run can answer a different --hash query without re-fetching
+			// this image.
+			triple, err := computeHashTriple(img)
 			if err != nil {
 				log.Printf("Failed to hash image from %s: %v\n", record.PhotoURL, err)
-				results <- struct{}{}
+				finish()
 				continue
 			}
 
-			isDuplicate := false
-			hashStore.Range(func(key, value interface{}) bool {
-				existingRecord := key.(ImageRecord)
-				existingHash := value.(*goimagehash.ImageHash)
-				distance, _ := hash.Distance(existingHash)
-				if distance < threshold {
-					isDuplicate = true
-
-					mu.Lock()
-					if _, exists := duplicateMap[record.FrontlinerID]; !exists {
-						duplicateMap[record.FrontlinerID] = make(map[string]*DuplicateRecord)
-					}
-					if _, exists := duplicateMap[record.FrontlinerID][existingRecord.FrontlinerID]; !exists {
-						duplicateMap[record.FrontlinerID][existingRecord.FrontlinerID] = &DuplicateRecord{
-							FrontlinerID:       record.FrontlinerID,
-							DuplicateImageURLs: []string{},
-							DuplicateIDs:       []string{},
-						}
+			indexRecord := phashindex.ImageRecord{ID: record.ID, FrontlinerID: record.FrontlinerID, PhotoURL: record.PhotoURL}
+			recordDuplicate := func(otherFrontlinerID, otherPhotoURL, otherID string) {
+				mu.Lock()
+				defer mu.Unlock()
+				if _, exists := duplicateMap[record.FrontlinerID]; !exists {
+					duplicateMap[record.FrontlinerID] = make(map[string]*DuplicateRecord)
+				}
+				if _, exists := duplicateMap[record.FrontlinerID][otherFrontlinerID]; !exists {
+					duplicateMap[record.FrontlinerID][otherFrontlinerID] = &DuplicateRecord{
+						FrontlinerID:       record.FrontlinerID,
+						DuplicateImageURLs: []string{},
+						DuplicateIDs:       []string{},
 					}
+				}
+				duplicateRecord := duplicateMap[record.FrontlinerID][otherFrontlinerID]
+				duplicateRecord.DuplicateImageURLs = append(duplicateRecord.DuplicateImageURLs, record.PhotoURL, otherPhotoURL)
+				duplicateRecord.DuplicateIDs = append(duplicateRecord.DuplicateIDs, record.ID, otherID)
+			}
 
-					duplicateRecord := duplicateMap[record.FrontlinerID][existingRecord.FrontlinerID]
-					duplicateRecord.DuplicateImageURLs = append(duplicateRecord.DuplicateImageURLs, record.PhotoURL, existingRecord.PhotoURL)
-					duplicateRecord.DuplicateIDs = append(duplicateRecord.DuplicateIDs, record.ID, existingRecord.ID)
-					mu.Unlock()
-					return false
+			var isDuplicate bool
+			var ext256Hash *goimagehash.ExtImageHash
+
+			switch cfg.HashKind {
+			case HashKindComposite:
+				matches := cfg.CompositeIndex.Query(triple, cfg.CompositeThreshold)
+				for _, existing := range matches {
+					recordDuplicate(existing.Record.FrontlinerID, existing.Record.PhotoURL, existing.Record.ID)
+				}
+				isDuplicate = len(matches) > 0
+				if !isDuplicate {
+					cfg.CompositeIndex.Insert(triple, indexRecord)
 				}
-				return true
-			})
 
+			case HashKindPHash256:
+				ext256Hash, err = goimagehash.ExtPerceptionHash(img, 16, 16)
+				if err != nil {
+					log.Printf("Failed to hash image from %s: %v\n", record.PhotoURL, err)
+					finish()
+					continue
+				}
+				matches := cfg.Ext256Index.Query(ext256Hash, cfg.Threshold-1)
+				for _, existing := range matches {
+					recordDuplicate(existing.Record.FrontlinerID, existing.Record.PhotoURL, existing.Record.ID)
+				}
+				isDuplicate = len(matches) > 0
+				if !isDuplicate {
+					cfg.Ext256Index.Insert(ext256Hash, indexRecord)
+				}
+
+			default:
+				hash := selectHash(triple, cfg.HashKind)
+				matches := cfg.Index.Query(hash, cfg.Threshold-1)
+				for _, existing := range matches {
+					recordDuplicate(existing.Record.FrontlinerID, existing.Record.PhotoURL, existing.Record.ID)
+				}
+				isDuplicate = len(matches) > 0
+				if !isDuplicate {
+					cfg.Index.Insert(hash, indexRecord)
+				}
+			}
+
+			hashRow := HashRow{
+				PHash: int64FromHash(triple.PHash),
+				AHash: int64FromHash(triple.AHash),
+				DHash: int64FromHash(triple.DHash),
+			}
+			if ext256Hash != nil {
+				hashRow.PHash256 = ext256Hash.ToString()
+			}
+			if err := checkpoints.MarkHashed(record.PhotoURL, sha1Hex, hashRow.PHash); err != nil {
+				log.Printf("Failed to record checkpoint for %s: %v\n", record.PhotoURL, err)
+			}
 			if !isDuplicate {
-				hashStore.Store(record, hash)
+				if err := store.Insert(record, hashRow); err != nil {
+					log.Printf("Failed to persist hash for %s: %v\n", record.PhotoURL, err)
+				}
 			}
-			results <- struct{}{}
+			finish()
 		}
 	}
 
@@ -250,7 +512,7 @@ func writeFailedRecordsToExcel(failedRecords []FailedRecord, filename string) er
 	f := excelize.NewFile()
 	sheet := "Sheet1"
 
-	headers := []string{"id", "store_id", "frontliner_id", "photo_url"}
+	headers := []string{"id", "store_id", "frontliner_id", "photo_url", "last_status"}
 	for col, header := range headers {
 		cell, _ := excelize.CoordinatesToCellName(col+1, 1)
 		err := f.SetCellValue(sheet, cell, header)
@@ -276,6 +538,10 @@ func writeFailedRecordsToExcel(failedRecords []FailedRecord, filename string) er
 		if err != nil {
 			return err
 		}
+		err = f.SetCellValue(sheet, fmt.Sprintf("E%d", i+2), record.LastStatus)
+		if err != nil {
+			return err
+		}
 	}
 
 	return f.SaveAs(filename)
@@ -287,6 +553,24 @@ func main() {
 	failedExcelFilename := "failed_downloads.xlsx"
 	threshold := 1
 
+	dbPath := flag.String("db", "hashes.db", "path to the SQLite database used to persist perceptual hashes across runs")
+	checkpointDBPath := flag.String("checkpoint-db", "checkpoint.db", "path to the SQLite database used to track per-URL download/hash progress")
+	cacheDir := flag.String("cache-dir", "cache", "directory used to content-address cache downloaded image bytes")
+	resume := flag.Bool("resume", false, "skip URLs already marked hashed or failed in the checkpoint database")
+	hashFlag := flag.String("hash", "phash", "hashing strategy: phash, ahash, dhash, phash256, or composite")
+	weightPHash := flag.Float64("weight-phash", 1, "weight of the phash distance in --hash=composite's score")
+	weightAHash := flag.Float64("weight-ahash", 1, "weight of the ahash distance in --hash=composite's score")
+	weightDHash := flag.Float64("weight-dhash", 1, "weight of the dhash distance in --hash=composite's score")
+	compositeThreshold := flag.Float64("composite-threshold", 3, "maximum weighted composite distance to flag as a duplicate")
+	rateLimit := flag.Float64("rate-limit", 5, "max requests per second to any single host")
+	rateBurst := flag.Int("rate-burst", 5, "burst size allowed on top of --rate-limit for any single host")
+	flag.Parse()
+
+	hashKind, err := parseHashKind(*hashFlag)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+
 	start := time.Now()
 
 	imageRecords, err := parseCSV(csvFilename)
@@ -294,7 +578,73 @@ func main() {
 		log.Fatalf("Failed to read CSV file: %v\n", err)
 	}
 
-	duplicates, failedRecords := detectDuplicates(imageRecords, threshold)
+	store, err := OpenHashStore(*dbPath)
+	if err != nil {
+		log.Fatalf("Failed to open hash store: %v\n", err)
+	}
+	defer store.Close()
+
+	checkpoints, err := OpenCheckpointStore(*checkpointDBPath)
+	if err != nil {
+		log.Fatalf("Failed to open checkpoint store: %v\n", err)
+	}
+	defer checkpoints.Close()
+
+	cache, err := NewImageCache(*cacheDir)
+	if err != nil {
+		log.Fatalf("Failed to open image cache: %v\n", err)
+	}
+
+	cfg := ScanConfig{
+		HashKind:           hashKind,
+		Threshold:          threshold,
+		CompositeThreshold: *compositeThreshold,
+		Index:              phashindex.NewBKTree(),
+		CompositeIndex:     NewCompositeIndex(CompositeWeights{PHash: *weightPHash, AHash: *weightAHash, DHash: *weightDHash}),
+		Ext256Index:        NewExt256Index(),
+		Limiter:            NewHostLimiter(*rateLimit, *rateBurst),
+	}
+
+	existing, err := store.All()
+	if err != nil {
+		log.Fatalf("Failed to load existing hashes: %v\n", err)
+	}
+	for _, row := range existing {
+		indexRecord := phashindex.ImageRecord{ID: row.Record.ID, FrontlinerID: row.Record.FrontlinerID, PhotoURL: row.Record.PhotoURL}
+		triple := HashTriple{
+			PHash: imageHashFromInt64(row.PHash, goimagehash.PHash),
+			AHash: imageHashFromInt64(row.AHash, goimagehash.AHash),
+			DHash: imageHashFromInt64(row.DHash, goimagehash.DHash),
+		}
+		switch hashKind {
+		case HashKindComposite:
+			cfg.CompositeIndex.Insert(triple, indexRecord)
+		case HashKindPHash256:
+			if row.PHash256 == "" {
+				continue
+			}
+			ext256Hash, err := goimagehash.ExtImageHashFromString(row.PHash256)
+			if err != nil {
+				log.Printf("Failed to parse stored phash256 for %s: %v\n", row.Record.PhotoURL, err)
+				continue
+			}
+			cfg.Ext256Index.Insert(ext256Hash, indexRecord)
+		default:
+			cfg.Index.Insert(selectHash(triple, hashKind), indexRecord)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	bar := pb.StartNew(len(imageRecords))
+
+	duplicates, failedRecords := detectDuplicates(ctx, imageRecords, store, checkpoints, cache, *resume, bar, cfg)
+	bar.Finish()
+
+	if ctx.Err() != nil {
+		fmt.Printf("Cancelled, flushing results collected so far.\n")
+	}
 	fmt.Printf("Duplicate detection complete.\n")
 
 	err = writeResultsToExcel(duplicates, duplicatesExcelFilename)
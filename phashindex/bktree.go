@@ -0,0 +1,102 @@
+// Package phashindex provides a BK-tree index over perceptual hashes so that
+// duplicate lookups can run in roughly O(log N) instead of scanning every
+// previously seen image.
+package phashindex
+
+import (
+	"sync"
+
+	"github.com/corona10/goimagehash"
+)
+
+// ImageRecord identifies the image a stored hash belongs to.
+type ImageRecord struct {
+	ID           string
+	FrontlinerID string
+	PhotoURL     string
+}
+
+// Match is a hit returned by Query: a previously inserted record whose hash
+// is within the query radius of the queried hash.
+type Match struct {
+	Record   ImageRecord
+	Distance int
+}
+
+// node is a single BK-tree node. children is keyed by the Hamming distance
+// from this node's hash to the child's hash, which is what makes the
+// triangle-inequality pruning in Query possible.
+type node struct {
+	hash     *goimagehash.ImageHash
+	record   ImageRecord
+	children map[int]*node
+}
+
+// BKTree is a Burkhard-Keller tree over perceptual hashes, using Hamming
+// distance as the metric. Reads and writes are safe for concurrent use.
+type BKTree struct {
+	mu   sync.RWMutex
+	root *node
+}
+
+// NewBKTree returns an empty BK-tree.
+func NewBKTree() *BKTree {
+	return &BKTree{}
+}
+
+// Insert adds hash/rec to the tree.
+func (t *BKTree) Insert(hash *goimagehash.ImageHash, rec ImageRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	leaf := &node{hash: hash, record: rec}
+	if t.root == nil {
+		t.root = leaf
+		return
+	}
+
+	cur := t.root
+	for {
+		d, _ := hash.Distance(cur.hash)
+		child, ok := cur.children[d]
+		if !ok {
+			if cur.children == nil {
+				cur.children = make(map[int]*node)
+			}
+			cur.children[d] = leaf
+			return
+		}
+		cur = child
+	}
+}
+
+// Query returns every record within maxDistance of hash. Because Hamming
+// distance is a metric, a child edge labeled k can only lead to hashes at
+// distance in [d-k, d+k] from the query (where d is the distance from the
+// query to the current node), so edges with |k-d| > maxDistance are skipped
+// entirely rather than descended into.
+func (t *BKTree) Query(hash *goimagehash.ImageHash, maxDistance int) []Match {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.root == nil {
+		return nil
+	}
+
+	var matches []Match
+	var visit func(n *node)
+	visit = func(n *node) {
+		d, _ := hash.Distance(n.hash)
+		if d <= maxDistance {
+			matches = append(matches, Match{Record: n.record, Distance: d})
+		}
+		for k, child := range n.children {
+			if k-d <= maxDistance && d-k <= maxDistance {
+				visit(child)
+			}
+		}
+	}
+	visit(t.root)
+
+	return matches
+}
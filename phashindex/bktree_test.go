@@ -0,0 +1,84 @@
+package phashindex
+
+import (
+	"math/bits"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/corona10/goimagehash"
+)
+
+// linearQuery is the O(N) reference implementation Query is meant to match:
+// it scores every inserted hash against query and keeps the ones within
+// maxDistance.
+func linearQuery(entries []uint64, records []ImageRecord, query uint64, maxDistance int) []Match {
+	var matches []Match
+	for i, h := range entries {
+		d := bits.OnesCount64(h ^ query)
+		if d <= maxDistance {
+			matches = append(matches, Match{Record: records[i], Distance: d})
+		}
+	}
+	return matches
+}
+
+func sortMatches(matches []Match) {
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		return matches[i].Record.ID < matches[j].Record.ID
+	})
+}
+
+func TestBKTreeQueryMatchesLinearScan(t *testing.T) {
+	hashes := []uint64{
+		0x0000000000000000,
+		0x0000000000000001,
+		0x0000000000000003,
+		0x00000000000000FF,
+		0x000000000000FFFF,
+		0x00000000FFFFFFFF,
+		0xFFFFFFFFFFFFFFFF,
+		0xFFFFFFFFFFFFFFFE,
+		0x8000000000000000,
+		0xAAAAAAAAAAAAAAAA,
+		0x5555555555555555,
+		0x123456789ABCDEF0,
+	}
+
+	records := make([]ImageRecord, len(hashes))
+	for i := range hashes {
+		records[i] = ImageRecord{ID: string(rune('a' + i)), FrontlinerID: "f", PhotoURL: "url"}
+	}
+
+	tree := NewBKTree()
+	for i, h := range hashes {
+		tree.Insert(goimagehash.NewImageHash(h, goimagehash.PHash), records[i])
+	}
+
+	queries := []uint64{0x0000000000000000, 0xFFFFFFFFFFFFFFFF, 0x00000000000000FF, 0xAAAAAAAAAAAAAAAA}
+
+	for _, query := range queries {
+		for _, maxDistance := range []int{0, 1, 3, 8, 16, 32, 64} {
+			got := tree.Query(goimagehash.NewImageHash(query, goimagehash.PHash), maxDistance)
+			want := linearQuery(hashes, records, query, maxDistance)
+
+			sortMatches(got)
+			sortMatches(want)
+
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("query %#x maxDistance %d: got %+v, want %+v", query, maxDistance, got, want)
+			}
+		}
+	}
+}
+
+func TestBKTreeQueryEmptyTree(t *testing.T) {
+	tree := NewBKTree()
+	got := tree.Query(goimagehash.NewImageHash(0, goimagehash.PHash), 64)
+	if got != nil {
+		t.Fatalf("query on empty tree: got %+v, want nil", got)
+	}
+}
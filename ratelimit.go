@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// HostLimiter hands out a token-bucket rate.Limiter per host, so a single
+// bursty CDN host can't drown out the shared httpClient (or get our IP
+// throttled/banned) while other hosts keep downloading at full speed.
+type HostLimiter struct {
+	rps   rate.Limit
+	burst int
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+// NewHostLimiter returns a limiter that allows rps requests per second,
+// with bursts up to burst, for each distinct host.
+func NewHostLimiter(rps float64, burst int) *HostLimiter {
+	return &HostLimiter{
+		rps:      rate.Limit(rps),
+		burst:    burst,
+		limiters: make(map[string]*rate.Limiter),
+	}
+}
+
+// Wait blocks until rawURL's host is allowed to make another request, or
+// ctx is done.
+func (h *HostLimiter) Wait(ctx context.Context, rawURL string) error {
+	host := rawURL
+	if u, err := url.Parse(rawURL); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	return h.forHost(host).Wait(ctx)
+}
+
+func (h *HostLimiter) forHost(host string) *rate.Limiter {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	l, ok := h.limiters[host]
+	if !ok {
+		l = rate.NewLimiter(h.rps, h.burst)
+		h.limiters[host] = l
+	}
+	return l
+}